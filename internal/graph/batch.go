@@ -0,0 +1,250 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/authzed/spicedb/internal/datastore"
+	v0 "github.com/authzed/spicedb/pkg/proto/authzed/api/v0"
+)
+
+// defaultBatchWindow is how long the batcher waits for more requests to arrive before issuing a
+// datastore scan, once the first request for a given (namespace, relation, revision) shows up.
+const defaultBatchWindow = 1 * time.Millisecond
+
+// defaultMaxBatchSize caps how many object IDs are folded into a single QueryTuples call, so that
+// a pathologically wide fan-out doesn't produce one enormous WithObjectIDs query.
+const defaultMaxBatchSize = 100
+
+// tupleBatchKey groups dispatched subchecks that can be satisfied by a single datastore scan: they
+// share the namespace and relation being queried, and must be answered at the same revision.
+type tupleBatchKey struct {
+	namespace  string
+	relation   string
+	atRevision datastore.Revision
+}
+
+// tupleBatchRequest is one waiter's interest in the tuples for a single object ID within a batch.
+type tupleBatchRequest struct {
+	ctx        context.Context
+	objectID   string
+	resultChan chan tupleBatchResult
+}
+
+type tupleBatchResult struct {
+	tuples []*v0.RelationTuple
+	err    error
+}
+
+type pendingTupleBatch struct {
+	requests []*tupleBatchRequest
+	timer    *time.Timer
+}
+
+// tupleBatcher buffers per-object-ID tuple lookups that arrive close together in time and
+// coalesces them into a single ds.QueryTuples(...).WithObjectIDs(...) call, then demultiplexes the
+// results back to each waiter. This exists because checkDirect and checkTupleToUserset otherwise
+// issue one point query per dispatched subcheck, even when many subchecks land on the same
+// namespace/relation within milliseconds of each other.
+type tupleBatcher struct {
+	ds           datastore.GraphDatastore
+	window       time.Duration
+	maxBatchSize int
+
+	mu      sync.Mutex
+	batches map[tupleBatchKey]*pendingTupleBatch
+}
+
+// newTupleBatcher constructs a tupleBatcher with the given coalescing window and max batch size. A
+// zero window or size selects the package defaults.
+func newTupleBatcher(ds datastore.GraphDatastore, window time.Duration, maxBatchSize int) *tupleBatcher {
+	if window <= 0 {
+		window = defaultBatchWindow
+	}
+	if maxBatchSize <= 0 {
+		maxBatchSize = defaultMaxBatchSize
+	}
+
+	return &tupleBatcher{
+		ds:           ds,
+		window:       window,
+		maxBatchSize: maxBatchSize,
+		batches:      make(map[tupleBatchKey]*pendingTupleBatch),
+	}
+}
+
+// queryTuplesForObject returns the tuples for (namespace, relation, objectID) at atRevision,
+// transparently batched with concurrent requests sharing the same (namespace, relation,
+// atRevision).
+func (b *tupleBatcher) queryTuplesForObject(
+	ctx context.Context,
+	namespace, relation string,
+	atRevision datastore.Revision,
+	objectID string,
+) ([]*v0.RelationTuple, error) {
+	key := tupleBatchKey{namespace: namespace, relation: relation, atRevision: atRevision}
+	req := &tupleBatchRequest{ctx: ctx, objectID: objectID, resultChan: make(chan tupleBatchResult, 1)}
+
+	b.mu.Lock()
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &pendingTupleBatch{}
+		b.batches[key] = batch
+		batch.timer = time.AfterFunc(b.window, func() { b.flush(key) })
+	}
+	batch.requests = append(batch.requests, req)
+	flushNow := len(batch.requests) >= b.maxBatchSize
+	if flushNow {
+		batch.timer.Stop()
+		delete(b.batches, key)
+	}
+	b.mu.Unlock()
+
+	if flushNow {
+		b.execute(key, batch.requests)
+	}
+
+	select {
+	case result := <-req.resultChan:
+		return result.tuples, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *tupleBatcher) flush(key tupleBatchKey) {
+	b.mu.Lock()
+	batch, ok := b.batches[key]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.batches, key)
+	b.mu.Unlock()
+
+	b.execute(key, batch.requests)
+}
+
+// execute issues the coalesced datastore scan for a batch and demultiplexes the results. Waiters
+// whose context has already been canceled (e.g. by a sibling short-circuit) are dropped before the
+// query is even issued, so a canceled Any/All/Difference branch doesn't pay for work no one needs.
+func (b *tupleBatcher) execute(key tupleBatchKey, requests []*tupleBatchRequest) {
+	live := make([]*tupleBatchRequest, 0, len(requests))
+	objectIDs := make([]string, 0, len(requests))
+	seen := make(map[string]struct{}, len(requests))
+	for _, req := range requests {
+		if req.ctx.Err() != nil {
+			continue
+		}
+		live = append(live, req)
+		if _, ok := seen[req.objectID]; !ok {
+			seen[req.objectID] = struct{}{}
+			objectIDs = append(objectIDs, req.objectID)
+		}
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	log.Trace().Str("namespace", key.namespace).Str("relation", key.relation).Int("batch_size", len(objectIDs)).Msg("batched tuple query")
+
+	// The scan runs on a context scoped to this batch, not context.Background(): it's canceled as
+	// soon as every live waiter's own context is done, so a client disconnect, a sibling
+	// short-circuit, or a server-side timeout still actually cancels the in-flight datastore call
+	// instead of letting it run to completion on everyone's behalf.
+	batchCtx, cancelBatch := mergedContext(live)
+	defer cancelBatch()
+
+	byObjectID, err := b.scan(batchCtx, key, objectIDs)
+	for _, req := range live {
+		if err != nil {
+			req.resultChan <- tupleBatchResult{err: err}
+			continue
+		}
+		req.resultChan <- tupleBatchResult{tuples: byObjectID[req.objectID]}
+	}
+}
+
+// mergedContext returns a context that stays alive as long as at least one of requests' own
+// contexts is still live, and is canceled the moment all of them are done. It has no deadline or
+// cause of its own beyond that: the batch's datastore scan is done on behalf of whichever waiters
+// are still around, not any single one of them.
+func mergedContext(requests []*tupleBatchRequest) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if len(requests) == 0 {
+		cancel()
+		return ctx, cancel
+	}
+
+	var remaining int32 = int32(len(requests))
+	for _, req := range requests {
+		go func(req *tupleBatchRequest) {
+			<-req.ctx.Done()
+			if atomic.AddInt32(&remaining, -1) == 0 {
+				cancel()
+			}
+		}(req)
+	}
+
+	return ctx, cancel
+}
+
+// scan performs the actual datastore call for a batch, preferring the single WithObjectIDs scan
+// and falling back to one scan per object ID if the datastore implementation doesn't support it.
+func (b *tupleBatcher) scan(ctx context.Context, key tupleBatchKey, objectIDs []string) (map[string][]*v0.RelationTuple, error) {
+	byObjectID := make(map[string][]*v0.RelationTuple, len(objectIDs))
+
+	it, err := b.ds.QueryTuples(key.namespace, key.atRevision).
+		WithObjectIDs(objectIDs).
+		WithRelation(key.relation).
+		Execute(ctx)
+	if errors.Is(err, datastore.ErrObjectIDsUnsupported) {
+		return b.scanFallback(ctx, key, objectIDs)
+	}
+	if err != nil {
+		return nil, NewCheckFailureErr(err)
+	}
+	defer it.Close()
+
+	for tpl := it.Next(); tpl != nil; tpl = it.Next() {
+		objectID := tpl.ObjectAndRelation.ObjectId
+		byObjectID[objectID] = append(byObjectID[objectID], tpl)
+	}
+	if it.Err() != nil {
+		return nil, NewCheckFailureErr(it.Err())
+	}
+
+	return byObjectID, nil
+}
+
+// scanFallback degrades to the pre-batching behavior of one QueryTuples call per object ID, for
+// datastore implementations that don't yet support WithObjectIDs.
+func (b *tupleBatcher) scanFallback(ctx context.Context, key tupleBatchKey, objectIDs []string) (map[string][]*v0.RelationTuple, error) {
+	byObjectID := make(map[string][]*v0.RelationTuple, len(objectIDs))
+
+	for _, objectID := range objectIDs {
+		it, err := b.ds.QueryTuples(key.namespace, key.atRevision).
+			WithObjectID(objectID).
+			WithRelation(key.relation).
+			Execute(ctx)
+		if err != nil {
+			return nil, NewCheckFailureErr(err)
+		}
+
+		for tpl := it.Next(); tpl != nil; tpl = it.Next() {
+			byObjectID[objectID] = append(byObjectID[objectID], tpl)
+		}
+		closeErr := it.Err()
+		it.Close()
+		if closeErr != nil {
+			return nil, NewCheckFailureErr(closeErr)
+		}
+	}
+
+	return byObjectID, nil
+}
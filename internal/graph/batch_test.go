@@ -0,0 +1,34 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergedContextCanceledOnceAllWaitersDone(t *testing.T) {
+	ctxA, cancelA := context.WithCancel(context.Background())
+	ctxB, cancelB := context.WithCancel(context.Background())
+
+	merged, cancelMerged := mergedContext([]*tupleBatchRequest{{ctx: ctxA}, {ctx: ctxB}})
+	defer cancelMerged()
+
+	require.NoError(t, merged.Err(), "must stay live while any waiter is still live")
+
+	cancelA()
+	require.Never(t, func() bool { return merged.Err() != nil }, 50*time.Millisecond, 10*time.Millisecond,
+		"must not be canceled while a waiter is still live")
+
+	cancelB()
+	require.Eventually(t, func() bool { return merged.Err() != nil }, time.Second, 10*time.Millisecond,
+		"must be canceled once every waiter is done")
+}
+
+func TestMergedContextWithNoRequestsIsAlreadyCanceled(t *testing.T) {
+	merged, cancel := mergedContext(nil)
+	defer cancel()
+
+	require.Error(t, merged.Err())
+}
@@ -0,0 +1,192 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheKey identifies a (Start, Goal, AtRevision) subproblem together with the depth of its
+// VisitedPath. AtRevision is included verbatim because a cached result is only valid for the
+// revision it was computed at. The VisitedPath depth is included because a result produced under
+// cycle-detection pruning (see cycle.go) is only correct for callers who arrived via an equivalent
+// path: the same (Start, Goal, AtRevision) walked via a different ancestry could have a different
+// answer if an ancestor ONR on one path happens to coincide with a node being checked on the other.
+// Only the depth is in the key, not the ONRs on the path, so two different ancestries of the same
+// depth share a key. See shouldCache, which additionally refuses to cache any result a cycle
+// pruned, rather than relying on this key alone.
+type cacheKey string
+
+func checkCacheKey(req CheckRequest) cacheKey {
+	return cacheKey(fmt.Sprintf(
+		"%s:%s:%s@%s:%s:%s@%s#%d",
+		req.Start.Namespace, req.Start.ObjectId, req.Start.Relation,
+		req.Goal.Namespace, req.Goal.ObjectId, req.Goal.Relation,
+		req.AtRevision,
+		req.VisitedPath.depthOf(),
+	))
+}
+
+// estimatedEntryBytes is a rough per-entry memory estimate (ONR strings, revision token, map/LRU
+// bookkeeping) used to translate a caller's byte budget into a number of LRU entries. It's a
+// coarse approximation, not an accounting of actual allocation sizes.
+const estimatedEntryBytes = 256
+
+// cacheShardCount is the number of independent LRU shards backing a cachingChecker's cache. The
+// cache is sharded so that concurrent Check calls for unrelated subproblems (the common case under
+// the fan-out done by Any/All/Difference) don't serialize on a single LRU's lock.
+const cacheShardCount = 16
+
+// shardedCache is a fixed number of independently-locked LRU shards, selected by hashing
+// cacheKey, plus a revision index used to evict an entire stale revision's entries at once: once
+// results are cached across enough distinct revisions, older ones are pure dead weight, since a
+// datastore revision that's no longer the head can't be queried against again in the common case.
+type shardedCache struct {
+	shards [cacheShardCount]*lru.Cache[cacheKey, CheckResult]
+
+	mu           sync.Mutex
+	revisions    []string // revisions seen, oldest first
+	keysByRev    map[string][]cacheKey
+	maxRevisions int
+}
+
+func newShardedCache(maxBytes int) (*shardedCache, error) {
+	perShard := maxBytes / estimatedEntryBytes / cacheShardCount
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	sc := &shardedCache{
+		keysByRev:    make(map[string][]cacheKey),
+		maxRevisions: 2,
+	}
+	for i := range sc.shards {
+		shard, err := lru.New[cacheKey, CheckResult](perShard)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct check cache shard: %w", err)
+		}
+		sc.shards[i] = shard
+	}
+	return sc, nil
+}
+
+func (sc *shardedCache) shardFor(key cacheKey) *lru.Cache[cacheKey, CheckResult] {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return sc.shards[h.Sum32()%cacheShardCount]
+}
+
+func (sc *shardedCache) get(key cacheKey) (CheckResult, bool) {
+	return sc.shardFor(key).Get(key)
+}
+
+// add records result under key, and tracks key against revision so the whole revision can later
+// be evicted in one pass once it's old enough that it will never be queried again.
+func (sc *shardedCache) add(key cacheKey, revision string, result CheckResult) {
+	sc.shardFor(key).Add(key, result)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.keysByRev[revision]; !ok {
+		sc.revisions = append(sc.revisions, revision)
+	}
+	sc.keysByRev[revision] = append(sc.keysByRev[revision], key)
+
+	for len(sc.revisions) > sc.maxRevisions {
+		stale := sc.revisions[0]
+		sc.revisions = sc.revisions[1:]
+		for _, staleKey := range sc.keysByRev[stale] {
+			sc.shardFor(staleKey).Remove(staleKey)
+		}
+		delete(sc.keysByRev, stale)
+	}
+}
+
+// cachingChecker is a Dispatcher that memoizes CheckResults for previously-seen subproblems,
+// keyed by (Start, Goal, AtRevision, VisitedPath depth). It is meant to be layered around another
+// Dispatcher, e.g. caching -> local -> caching, so that both top-level and recursively-dispatched
+// subchecks can be served from cache.
+//
+// Only successful, cycle-unaffected results are cached: see shouldCache.
+type cachingChecker struct {
+	delegate    Dispatcher
+	cache       *shardedCache
+	flightGroup singleflight.Group
+}
+
+// CachingCheckerConfig configures the size of the subproblem cache fronting a Dispatcher.
+type CachingCheckerConfig struct {
+	// MaxBytes is the approximate memory budget for the cache, spread across its shards. Entries
+	// beyond the budget are evicted least-recently-used first, per shard.
+	MaxBytes int
+}
+
+// NewCachingDispatcher wraps delegate with a content-addressed, sharded LRU cache of CheckResults,
+// so that repeated or concurrent Check calls against overlapping object graphs can reuse prior
+// work instead of re-walking the same subproblem.
+func NewCachingDispatcher(delegate Dispatcher, config CachingCheckerConfig) (Dispatcher, error) {
+	maxBytes := config.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 64 * 1024 * 1024 // 64MiB
+	}
+
+	cache, err := newShardedCache(maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachingChecker{delegate: delegate, cache: cache}, nil
+}
+
+// shouldCache reports whether result is safe to memoize under a bare (Start, Goal, AtRevision,
+// VisitedPath depth) key. A result is never cached if it errored (failures like timeouts or datastore
+// errors aren't safe to memoize), and never cached if any part of computing it was short-circuited
+// by cycle detection: a cycle-pruned NotMember is only correct for callers who share this exact
+// ancestry, and while VisitedPath's depth is part of the key, two structurally-different paths of the
+// same depth collide there, so we additionally refuse to cache anything cycle detection touched.
+func shouldCache(result CheckResult) bool {
+	return result.Err == nil && result.Metadata.CycleAvoidedDispatches == 0
+}
+
+func (cc *cachingChecker) Check(ctx context.Context, req CheckRequest) CheckResult {
+	key := checkCacheKey(req)
+
+	if cached, ok := cc.cache.get(key); ok {
+		log.Trace().Object("cache hit", req).Send()
+		return cached
+	}
+
+	// Concurrent identical subproblems coalesce onto a single in-flight delegate call, mirroring
+	// the fan-out done by the Any/All/Difference reducers. singleflight.Do hands that one call's
+	// result to every caller sharing this key, including callers whose own context is perfectly
+	// healthy -- so the delegate must run on a context that can outlive any single one of them,
+	// not whichever caller happened to be first through the door. Otherwise a sibling short-circuit
+	// or a disconnecting client on one caller's request tree would spuriously fail every other
+	// concurrent caller's live, unrelated check. Only cancellation is detached: if the caller that
+	// starts the shared call has a deadline, that deadline still bounds the delegate call, and so
+	// the result every caller sharing this key receives.
+	delegateCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		delegateCtx, cancel = context.WithDeadline(delegateCtx, deadline)
+		defer cancel()
+	}
+
+	result, err, _ := cc.flightGroup.Do(string(key), func() (interface{}, error) {
+		result := cc.delegate.Check(delegateCtx, req)
+		if shouldCache(result) {
+			cc.cache.add(key, fmt.Sprintf("%v", req.AtRevision), result)
+		}
+		return result, nil
+	})
+	if err != nil {
+		return CheckResult{IsMember: false, Err: NewCheckFailureErr(err)}
+	}
+
+	return result.(CheckResult)
+}
@@ -0,0 +1,93 @@
+package graph
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/authzed/spicedb/internal/datastore"
+	v0 "github.com/authzed/spicedb/pkg/proto/authzed/api/v0"
+)
+
+// testAtRevision is an arbitrary, valid-for-testing datastore.Revision; its only requirement here
+// is that it's usable as a cacheKey component, not that it corresponds to a real datastore state.
+var testAtRevision datastore.Revision
+
+type fakeDispatcher struct {
+	checkFn func(ctx context.Context, req CheckRequest) CheckResult
+}
+
+func (f *fakeDispatcher) Check(ctx context.Context, req CheckRequest) CheckResult {
+	return f.checkFn(ctx, req)
+}
+
+func testCheckRequest() CheckRequest {
+	return CheckRequest{
+		Start:      &v0.ObjectAndRelation{Namespace: "document", ObjectId: "1", Relation: "viewer"},
+		Goal:       &v0.ObjectAndRelation{Namespace: "user", ObjectId: "tom", Relation: Ellipsis},
+		AtRevision: testAtRevision,
+	}
+}
+
+// A canceled caller sharing a cache key with a live one must not poison the live caller's result:
+// the delegate call backing a singleflight.Do group is shared across every caller with that key,
+// so it has to run on a context that outlives any single one of them. See the fix in
+// cachingChecker.Check.
+func TestCachingCheckerDecouplesDelegateContextFromCaller(t *testing.T) {
+	callerCtx, cancel := context.WithCancel(context.Background())
+	cancel() // the caller has already given up by the time Check is called
+
+	var observedCtx context.Context
+	delegate := &fakeDispatcher{checkFn: func(ctx context.Context, req CheckRequest) CheckResult {
+		observedCtx = ctx
+		return CheckResult{IsMember: true}
+	}}
+
+	dispatcher, err := NewCachingDispatcher(delegate, CachingCheckerConfig{})
+	require.NoError(t, err)
+
+	result := dispatcher.Check(callerCtx, testCheckRequest())
+	require.NoError(t, result.Err)
+	require.True(t, result.IsMember)
+	require.NoError(t, observedCtx.Err(), "the delegate must not observe the caller's own cancellation")
+}
+
+func TestCheckCacheKeyIncludesVisitedPathDepth(t *testing.T) {
+	req := testCheckRequest()
+
+	req.VisitedPath = nil
+	shallow := checkCacheKey(req)
+
+	req.VisitedPath = newCyclePath(req.Start).extend(req.Goal)
+	deep := checkCacheKey(req)
+
+	require.NotEqual(t, shallow, deep, "two ancestries of different depths must not collide on the same cache key")
+}
+
+func TestShouldCacheRefusesCycleAffectedResults(t *testing.T) {
+	require.True(t, shouldCache(CheckResult{IsMember: true}))
+	require.False(t, shouldCache(CheckResult{Err: NewCheckFailureErr(errSiblingFailed)}))
+	require.False(t, shouldCache(CheckResult{
+		IsMember: false,
+		Metadata: CheckResultMetadata{CycleAvoidedDispatches: 1},
+	}))
+}
+
+func TestShardedCacheEvictsOldestRevisionOnce(t *testing.T) {
+	sc, err := newShardedCache(1024 * 1024)
+	require.NoError(t, err)
+
+	keyA := cacheKey("a")
+	keyB := cacheKey("b")
+	sc.add(keyA, "rev-1", CheckResult{IsMember: true})
+	sc.add(keyB, "rev-2", CheckResult{IsMember: true})
+
+	// A third revision pushes the cache past maxRevisions (2), so the oldest (rev-1) is evicted.
+	sc.add(cacheKey("c"), "rev-3", CheckResult{IsMember: true})
+
+	_, ok := sc.get(keyA)
+	require.False(t, ok, "entries from an evicted revision must not remain cached")
+	_, ok = sc.get(keyB)
+	require.True(t, ok, "entries from a still-tracked revision must remain cached")
+}
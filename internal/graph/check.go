@@ -5,20 +5,32 @@ import (
 	"errors"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/authzed/spicedb/internal/datastore"
 	"github.com/authzed/spicedb/internal/namespace"
 	v0 "github.com/authzed/spicedb/pkg/proto/authzed/api/v0"
 )
 
-func newConcurrentChecker(d Dispatcher, ds datastore.GraphDatastore, nsm namespace.Manager) checker {
-	return &concurrentChecker{d: d, ds: ds, nsm: nsm}
+// newConcurrentChecker wraps d in a cachingChecker before storing it as the delegate used for
+// recursive dispatch, so that repeated subproblems within (and across) top-level Check calls are
+// served from cache rather than re-walked. Callers that also want the cache to cover work done
+// before it reaches this checker (e.g. a remote dispatch hop) should layer their own
+// NewCachingDispatcher around the Dispatcher that fronts this checker, giving the
+// caching -> local -> caching composition described in cachingChecker's docs.
+func newConcurrentChecker(d Dispatcher, ds datastore.GraphDatastore, nsm namespace.Manager) (checker, error) {
+	cachedDelegate, err := NewCachingDispatcher(d, CachingCheckerConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &concurrentChecker{d: cachedDelegate, nsm: nsm, batcher: newTupleBatcher(ds, 0, 0)}, nil
 }
 
 type concurrentChecker struct {
-	d   Dispatcher
-	ds  datastore.GraphDatastore
-	nsm namespace.Manager
+	d       Dispatcher
+	nsm     namespace.Manager
+	batcher *tupleBatcher
 }
 
 func onrEqual(lhs, rhs *v0.ObjectAndRelation) bool {
@@ -27,6 +39,16 @@ func onrEqual(lhs, rhs *v0.ObjectAndRelation) bool {
 }
 
 func (cc *concurrentChecker) check(ctx context.Context, req CheckRequest, relation *v0.Relation) ReduceableCheckFunc {
+	// If this request crossed a dispatch boundary, continue the caller's trace instead of starting
+	// a disconnected one.
+	ctx = extractTraceContext(ctx, req)
+
+	// Seed the cycle-detection path the first time we see this ONR; recursive calls carry their
+	// own (already-extended) VisitedPath along with them.
+	if req.VisitedPath == nil {
+		req.VisitedPath = newCyclePath(req.Start)
+	}
+
 	// If we have found the goal's ONR, then we know that the ONR is a member.
 	if onrEqual(req.Goal, req.Start) {
 		return AlwaysMember()
@@ -39,10 +61,62 @@ func (cc *concurrentChecker) check(ctx context.Context, req CheckRequest, relati
 	return cc.checkUsersetRewrite(ctx, req, relation.UsersetRewrite)
 }
 
+// Sentinel cancellation causes used by the set-operation reducers (Any, All, Difference) to tell
+// siblings *why* their context was canceled. Without these, a dispatch observing ctx.Done() cannot
+// distinguish "a sibling already satisfied/unsatisfied the parent" from a user-initiated cancel or a
+// downstream timeout, which matters for both metrics and for retry logic sitting in front of the
+// dispatcher.
+var (
+	errShortCircuitSatisfied   = errors.New("sibling short-circuit: parent already satisfied")
+	errShortCircuitUnsatisfied = errors.New("sibling short-circuit: parent already unsatisfied")
+	errSiblingFailed           = errors.New("sibling short-circuit: a sibling failed")
+
+	// errMaxDepthExceeded is returned by dispatch when a request arrives with no recursion budget
+	// left. cyclePath catches the common case (a cyclic userset graph) immediately, but a graph
+	// that's merely very deep and not cyclic would otherwise recurse until some other resource
+	// gives out; DepthRemaining is the backstop for that, per DefaultDepthRemaining's doc comment
+	// in cycle.go, which means it has to actually be enforced somewhere.
+	errMaxDepthExceeded = errors.New("max recursion depth exceeded")
+)
+
+// checkResultFromCause builds the CheckResult to return when ctx has been canceled, consulting
+// context.Cause so that a short-circuit from a sibling reducer surfaces as a typed CheckFailureErr
+// wrapping that cause rather than an indistinguishable RequestCanceledErr.
+func checkResultFromCause(ctx context.Context) CheckResult {
+	cause := context.Cause(ctx)
+	if cause == nil || errors.Is(cause, context.Canceled) {
+		return CheckResult{IsMember: false, Err: NewRequestCanceledErr()}
+	}
+	return CheckResult{IsMember: false, Err: NewCheckFailureErr(cause)}
+}
+
 func (cc *concurrentChecker) dispatch(req CheckRequest) ReduceableCheckFunc {
 	return func(ctx context.Context, resultChan chan<- CheckResult) {
 		log.Trace().Object("dispatch", req).Send()
+		ctx, span := startCheckSpan(ctx, spanKindDispatch, req)
+		defer span.End()
+
+		if ctx.Err() != nil {
+			resultChan <- checkResultFromCause(ctx)
+			return
+		}
+
+		if req.DepthRemaining <= 0 {
+			err := NewCheckFailureErr(errMaxDepthExceeded)
+			span.RecordError(err)
+			resultChan <- CheckResult{IsMember: false, Err: err}
+			return
+		}
+
+		// Embed the current span context in the outgoing request so that if cc.d.Check forwards
+		// this subcheck to another node, the remote side's spans are parented to this trace
+		// instead of starting a new, disconnected one.
+		req.TraceContext = injectTraceContext(ctx)
+
 		result := cc.d.Check(ctx, req)
+		if result.Err != nil {
+			span.RecordError(result.Err)
+		}
 		resultChan <- result
 	}
 }
@@ -50,71 +124,108 @@ func (cc *concurrentChecker) dispatch(req CheckRequest) ReduceableCheckFunc {
 func (cc *concurrentChecker) checkDirect(ctx context.Context, req CheckRequest) ReduceableCheckFunc {
 	return func(ctx context.Context, resultChan chan<- CheckResult) {
 		log.Trace().Object("direct", req).Send()
-		it, err := cc.ds.QueryTuples(req.Start.Namespace, req.AtRevision).
-			WithObjectID(req.Start.ObjectId).
-			WithRelation(req.Start.Relation).
-			Execute(ctx)
+		ctx, span := startCheckSpan(ctx, spanKindDirect, req)
+		defer span.End()
+
+		// Dispatched subchecks landing on the same (namespace, relation, revision) within a small
+		// window are coalesced by the batcher into a single datastore scan.
+		tuples, err := cc.batcher.queryTuplesForObject(ctx, req.Start.Namespace, req.Start.Relation, req.AtRevision, req.Start.ObjectId)
 		if err != nil {
-			resultChan <- CheckResult{false, NewCheckFailureErr(err)}
+			if ctx.Err() != nil {
+				resultChan <- checkResultFromCause(ctx)
+				return
+			}
+			span.RecordError(err)
+			resultChan <- CheckResult{IsMember: false, Err: NewCheckFailureErr(err)}
 			return
 		}
-		defer it.Close()
 
 		var requestsToDispatch []ReduceableCheckFunc
-		for tpl := it.Next(); tpl != nil; tpl = it.Next() {
+		for _, tpl := range tuples {
+			if ctx.Err() != nil {
+				resultChan <- checkResultFromCause(ctx)
+				return
+			}
 			tplUserset := tpl.User.GetUserset()
 			if onrEqual(tplUserset, req.Goal) {
-				resultChan <- CheckResult{true, nil}
+				span.AddEvent(eventShortCircuitMember)
+				resultChan <- CheckResult{IsMember: true, Err: nil}
 				return
 			}
 			if tplUserset.Relation != Ellipsis {
 				// We need to recursively call check here, potentially changing namespaces
+				if req.VisitedPath.contains(tplUserset) {
+					requestsToDispatch = append(requestsToDispatch, cycleAvoided(req.VisitedPath))
+					continue
+				}
 				requestsToDispatch = append(requestsToDispatch, cc.dispatch(CheckRequest{
 					Start:          tplUserset,
 					Goal:           req.Goal,
 					AtRevision:     req.AtRevision,
 					DepthRemaining: req.DepthRemaining - 1,
+					VisitedPath:    req.VisitedPath.extend(tplUserset),
 				}))
 			}
 		}
-		if it.Err() != nil {
-			resultChan <- CheckResult{false, NewCheckFailureErr(it.Err())}
-			return
+		result := Any(ctx, requestsToDispatch)
+		if result.Err != nil {
+			span.RecordError(result.Err)
 		}
-		resultChan <- Any(ctx, requestsToDispatch)
+		resultChan <- result
 	}
 }
 
 func (cc *concurrentChecker) checkUsersetRewrite(ctx context.Context, req CheckRequest, usr *v0.UsersetRewrite) ReduceableCheckFunc {
 	switch rw := usr.RewriteOperation.(type) {
 	case *v0.UsersetRewrite_Union:
-		return cc.checkSetOperation(ctx, req, rw.Union, Any)
+		return cc.checkSetOperation(ctx, req, rw.Union, Any, spanKindUnion)
 	case *v0.UsersetRewrite_Intersection:
-		return cc.checkSetOperation(ctx, req, rw.Intersection, All)
+		return cc.checkSetOperation(ctx, req, rw.Intersection, All, spanKindIntersection)
 	case *v0.UsersetRewrite_Exclusion:
-		return cc.checkSetOperation(ctx, req, rw.Exclusion, Difference)
+		return cc.checkSetOperation(ctx, req, rw.Exclusion, Difference, spanKindExclusion)
 	default:
 		return AlwaysFail
 	}
 }
 
-func (cc *concurrentChecker) checkSetOperation(ctx context.Context, req CheckRequest, so *v0.SetOperation, reducer Reducer) ReduceableCheckFunc {
+func (cc *concurrentChecker) checkSetOperation(ctx context.Context, req CheckRequest, so *v0.SetOperation, reducer Reducer, kind string) ReduceableCheckFunc {
 	var requests []ReduceableCheckFunc
-	for _, childOneof := range so.Child {
-		switch child := childOneof.ChildType.(type) {
+	for index, childOneof := range so.Child {
+		var child ReduceableCheckFunc
+		switch c := childOneof.ChildType.(type) {
 		case *v0.SetOperation_Child_XThis:
-			requests = append(requests, cc.checkDirect(ctx, req))
+			child = cc.checkDirect(ctx, req)
 		case *v0.SetOperation_Child_ComputedUserset:
-			requests = append(requests, cc.checkComputedUserset(ctx, req, child.ComputedUserset, nil))
+			child = cc.checkComputedUserset(ctx, req, c.ComputedUserset, nil)
 		case *v0.SetOperation_Child_UsersetRewrite:
-			requests = append(requests, cc.checkUsersetRewrite(ctx, req, child.UsersetRewrite))
+			child = cc.checkUsersetRewrite(ctx, req, c.UsersetRewrite)
 		case *v0.SetOperation_Child_TupleToUserset:
-			requests = append(requests, cc.checkTupleToUserset(ctx, req, child.TupleToUserset))
+			child = cc.checkTupleToUserset(ctx, req, c.TupleToUserset)
+		default:
+			continue
 		}
+		requests = append(requests, withChildIndex(index, child))
 	}
 	return func(ctx context.Context, resultChan chan<- CheckResult) {
 		log.Trace().Object("set operation", req).Stringer("operation", so).Send()
-		resultChan <- reducer(ctx, requests)
+		ctx, span := startCheckSpan(ctx, kind, req,
+			attribute.Int("child_count", len(so.Child)))
+		defer span.End()
+
+		result := reducer(ctx, requests)
+		if result.Err != nil {
+			span.RecordError(result.Err)
+		}
+		resultChan <- result
+	}
+}
+
+// withChildIndex wraps fn so that any span it opens carries its position among the siblings it
+// was dispatched alongside, letting a trace reconstruct the original set-operation child order
+// even though Any/All/Difference run the children concurrently.
+func withChildIndex(index int, fn ReduceableCheckFunc) ReduceableCheckFunc {
+	return func(ctx context.Context, resultChan chan<- CheckResult) {
+		fn(contextWithChildIndex(ctx, index), resultChan)
 	}
 }
 
@@ -145,6 +256,12 @@ func (cc *concurrentChecker) checkComputedUserset(ctx context.Context, req Check
 		return AlwaysMember()
 	}
 
+	// If targetOnr is already on the path that got us here, dispatching to it again would just
+	// walk the same cycle: it didn't reach the goal the first time, so it can't reach it now.
+	if req.VisitedPath.contains(targetOnr) {
+		return cycleAvoided(req.VisitedPath)
+	}
+
 	// Check if the target relation exists. If not, return nothing.
 	err := cc.nsm.CheckNamespaceAndRelation(ctx, start.Namespace, cu.Relation, true)
 	if err != nil {
@@ -155,37 +272,54 @@ func (cc *concurrentChecker) checkComputedUserset(ctx context.Context, req Check
 		return CheckError(err)
 	}
 
-	return cc.dispatch(CheckRequest{
+	childReq := CheckRequest{
 		Start:          targetOnr,
 		Goal:           req.Goal,
 		AtRevision:     req.AtRevision,
 		DepthRemaining: req.DepthRemaining - 1,
-	})
+		VisitedPath:    req.VisitedPath.extend(targetOnr),
+	}
+	dispatchFn := cc.dispatch(childReq)
+	return func(ctx context.Context, resultChan chan<- CheckResult) {
+		ctx, span := startCheckSpan(ctx, spanKindComputedUserset, childReq)
+		defer span.End()
+		dispatchFn(ctx, resultChan)
+	}
 }
 
 func (cc *concurrentChecker) checkTupleToUserset(ctx context.Context, req CheckRequest, ttu *v0.TupleToUserset) ReduceableCheckFunc {
 	return func(ctx context.Context, resultChan chan<- CheckResult) {
 		log.Trace().Object("ttu", req).Send()
-		it, err := cc.ds.QueryTuples(req.Start.Namespace, req.AtRevision).
-			WithObjectID(req.Start.ObjectId).
-			WithRelation(ttu.Tupleset.Relation).
-			Execute(ctx)
+		ctx, span := startCheckSpan(ctx, spanKindTupleToUserset, req)
+		defer span.End()
+
+		// Dispatched subchecks landing on the same (namespace, tupleset relation, revision) within a
+		// small window are coalesced by the batcher into a single datastore scan.
+		tuples, err := cc.batcher.queryTuplesForObject(ctx, req.Start.Namespace, ttu.Tupleset.Relation, req.AtRevision, req.Start.ObjectId)
 		if err != nil {
-			resultChan <- CheckResult{false, NewCheckFailureErr(err)}
+			if ctx.Err() != nil {
+				resultChan <- checkResultFromCause(ctx)
+				return
+			}
+			span.RecordError(err)
+			resultChan <- CheckResult{IsMember: false, Err: NewCheckFailureErr(err)}
 			return
 		}
-		defer it.Close()
 
 		var requestsToDispatch []ReduceableCheckFunc
-		for tpl := it.Next(); tpl != nil; tpl = it.Next() {
+		for _, tpl := range tuples {
+			if ctx.Err() != nil {
+				resultChan <- checkResultFromCause(ctx)
+				return
+			}
 			requestsToDispatch = append(requestsToDispatch, cc.checkComputedUserset(ctx, req, ttu.ComputedUserset, tpl))
 		}
-		if it.Err() != nil {
-			resultChan <- CheckResult{false, NewCheckFailureErr(it.Err())}
-			return
-		}
 
-		resultChan <- Any(ctx, requestsToDispatch)
+		result := Any(ctx, requestsToDispatch)
+		if result.Err != nil {
+			span.RecordError(result.Err)
+		}
+		resultChan <- result
 	}
 }
 
@@ -196,45 +330,55 @@ func All(ctx context.Context, requests []ReduceableCheckFunc) CheckResult {
 	}
 
 	resultChan := make(chan CheckResult, len(requests))
-	childCtx, cancelFn := context.WithCancel(ctx)
-	defer cancelFn()
+	childCtx, cancelFn := context.WithCancelCause(ctx)
+	defer cancelFn(nil)
 
 	for _, req := range requests {
 		go req(childCtx, resultChan)
 	}
 
+	var metadata CheckResultMetadata
 	for i := 0; i < len(requests); i++ {
 		select {
 		case result := <-resultChan:
-			if result.Err != nil || !result.IsMember {
+			metadata = mergeMetadata(metadata, result.Metadata)
+			if result.Err != nil {
+				cancelFn(errSiblingFailed)
+				result.Metadata = metadata
+				return result
+			}
+			if !result.IsMember {
+				cancelFn(errShortCircuitUnsatisfied)
+				recordShortCircuit(ctx, eventShortCircuitNotMember)
+				result.Metadata = metadata
 				return result
 			}
 		case <-ctx.Done():
-			return CheckResult{IsMember: false, Err: NewRequestCanceledErr()}
+			return checkResultFromCause(ctx)
 		}
 	}
 
-	return CheckResult{IsMember: true, Err: nil}
+	return CheckResult{IsMember: true, Err: nil, Metadata: metadata}
 }
 
 // CheckError returns the error.
 func CheckError(err error) ReduceableCheckFunc {
 	return func(ctx context.Context, resultChan chan<- CheckResult) {
-		resultChan <- CheckResult{false, err}
+		resultChan <- CheckResult{IsMember: false, Err: err}
 	}
 }
 
 // AlwaysMember returns that the check always passes.
 func AlwaysMember() ReduceableCheckFunc {
 	return func(ctx context.Context, resultChan chan<- CheckResult) {
-		resultChan <- CheckResult{true, nil}
+		resultChan <- CheckResult{IsMember: true, Err: nil}
 	}
 }
 
 // NotMember returns that the check always returns false.
 func NotMember() ReduceableCheckFunc {
 	return func(ctx context.Context, resultChan chan<- CheckResult) {
-		resultChan <- CheckResult{false, nil}
+		resultChan <- CheckResult{IsMember: false, Err: nil}
 	}
 }
 
@@ -245,19 +389,24 @@ func Any(ctx context.Context, requests []ReduceableCheckFunc) CheckResult {
 	}
 
 	resultChan := make(chan CheckResult, len(requests))
-	childCtx, cancelFn := context.WithCancel(ctx)
-	defer cancelFn()
+	childCtx, cancelFn := context.WithCancelCause(ctx)
+	defer cancelFn(nil)
 
 	for _, req := range requests {
 		go req(childCtx, resultChan)
 	}
 
 	var downstreamError error
+	var metadata CheckResultMetadata
 	for i := 0; i < len(requests); i++ {
 		select {
 		case result := <-resultChan:
 			log.Trace().Object("any result", result).Send()
+			metadata = mergeMetadata(metadata, result.Metadata)
 			if result.Err == nil && result.IsMember {
+				cancelFn(errShortCircuitSatisfied)
+				recordShortCircuit(ctx, eventShortCircuitMember)
+				result.Metadata = metadata
 				return result
 			}
 			if result.Err != nil {
@@ -265,17 +414,20 @@ func Any(ctx context.Context, requests []ReduceableCheckFunc) CheckResult {
 			}
 		case <-ctx.Done():
 			log.Trace().Msg("any canceled")
-			return CheckResult{IsMember: false, Err: NewRequestCanceledErr()}
+			return checkResultFromCause(ctx)
 		}
 	}
 
-	return CheckResult{IsMember: false, Err: downstreamError}
+	if downstreamError != nil {
+		cancelFn(errSiblingFailed)
+	}
+	return CheckResult{IsMember: false, Err: downstreamError, Metadata: metadata}
 }
 
 // Difference returns whether the first lazy check passes and none of the supsequent checks pass.
 func Difference(ctx context.Context, requests []ReduceableCheckFunc) CheckResult {
-	childCtx, cancelFn := context.WithCancel(ctx)
-	defer cancelFn()
+	childCtx, cancelFn := context.WithCancelCause(ctx)
+	defer cancelFn(nil)
 
 	baseChan := make(chan CheckResult, 1)
 	othersChan := make(chan CheckResult, len(requests)-1)
@@ -285,20 +437,37 @@ func Difference(ctx context.Context, requests []ReduceableCheckFunc) CheckResult
 		go req(childCtx, othersChan)
 	}
 
+	var metadata CheckResultMetadata
 	for i := 0; i < len(requests); i++ {
 		select {
 		case base := <-baseChan:
-			if base.Err != nil || !base.IsMember {
+			metadata = mergeMetadata(metadata, base.Metadata)
+			if base.Err != nil {
+				cancelFn(errSiblingFailed)
+				base.Metadata = metadata
+				return base
+			}
+			if !base.IsMember {
+				cancelFn(errShortCircuitUnsatisfied)
+				recordShortCircuit(ctx, eventShortCircuitNotMember)
+				base.Metadata = metadata
 				return base
 			}
 		case sub := <-othersChan:
-			if sub.Err != nil || sub.IsMember {
-				return CheckResult{IsMember: false, Err: sub.Err}
+			metadata = mergeMetadata(metadata, sub.Metadata)
+			if sub.Err != nil {
+				cancelFn(errSiblingFailed)
+				return CheckResult{IsMember: false, Err: sub.Err, Metadata: metadata}
+			}
+			if sub.IsMember {
+				cancelFn(errShortCircuitUnsatisfied)
+				recordShortCircuit(ctx, eventShortCircuitNotMember)
+				return CheckResult{IsMember: false, Err: sub.Err, Metadata: metadata}
 			}
 		case <-ctx.Done():
-			return CheckResult{IsMember: false, Err: NewRequestCanceledErr()}
+			return checkResultFromCause(ctx)
 		}
 	}
 
-	return CheckResult{IsMember: true, Err: nil}
+	return CheckResult{IsMember: true, Err: nil, Metadata: metadata}
 }
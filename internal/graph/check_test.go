@@ -0,0 +1,99 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func member() ReduceableCheckFunc {
+	return func(ctx context.Context, resultChan chan<- CheckResult) {
+		resultChan <- CheckResult{IsMember: true}
+	}
+}
+
+func notMember() ReduceableCheckFunc {
+	return func(ctx context.Context, resultChan chan<- CheckResult) {
+		resultChan <- CheckResult{IsMember: false}
+	}
+}
+
+func failingCheck() ReduceableCheckFunc {
+	return func(ctx context.Context, resultChan chan<- CheckResult) {
+		resultChan <- CheckResult{Err: NewCheckFailureErr(context.DeadlineExceeded)}
+	}
+}
+
+// observeCause returns a ReduceableCheckFunc that blocks until its context is canceled and reports
+// the recorded context.Cause on causeChan, so a test can assert *why* a reducer canceled its
+// siblings instead of just what it returned.
+func observeCause(causeChan chan<- error) ReduceableCheckFunc {
+	return func(ctx context.Context, resultChan chan<- CheckResult) {
+		<-ctx.Done()
+		causeChan <- context.Cause(ctx)
+		resultChan <- CheckResult{}
+	}
+}
+
+func requireCause(t *testing.T, causeChan <-chan error, want error) {
+	t.Helper()
+	select {
+	case cause := <-causeChan:
+		require.ErrorIs(t, cause, want)
+	case <-time.After(time.Second):
+		t.Fatal("sibling never observed its context being canceled")
+	}
+}
+
+func TestAllCancelsSiblingsWithCauseMatchingOutcome(t *testing.T) {
+	t.Run("not member short-circuits with unsatisfied", func(t *testing.T) {
+		causeChan := make(chan error, 1)
+		result := All(context.Background(), []ReduceableCheckFunc{notMember(), observeCause(causeChan)})
+		require.False(t, result.IsMember)
+		requireCause(t, causeChan, errShortCircuitUnsatisfied)
+	})
+
+	t.Run("a failing sibling short-circuits with sibling failed", func(t *testing.T) {
+		causeChan := make(chan error, 1)
+		result := All(context.Background(), []ReduceableCheckFunc{failingCheck(), observeCause(causeChan)})
+		require.Error(t, result.Err)
+		requireCause(t, causeChan, errSiblingFailed)
+	})
+}
+
+func TestAnyCancelsSiblingsWithCauseMatchingOutcome(t *testing.T) {
+	t.Run("a member short-circuits with satisfied", func(t *testing.T) {
+		causeChan := make(chan error, 1)
+		result := Any(context.Background(), []ReduceableCheckFunc{member(), observeCause(causeChan)})
+		require.True(t, result.IsMember)
+		requireCause(t, causeChan, errShortCircuitSatisfied)
+	})
+}
+
+// This is the exact bug the chunk0-1 fix commit patched: a subtracted branch matching means the
+// overall Difference is unsatisfied, so siblings must be canceled with errShortCircuitUnsatisfied,
+// not errShortCircuitSatisfied.
+func TestDifferenceCancelsSiblingsWithUnsatisfiedCauseWhenSubtractedBranchMatches(t *testing.T) {
+	causeChan := make(chan error, 1)
+	result := Difference(context.Background(), []ReduceableCheckFunc{member(), member(), observeCause(causeChan)})
+	require.False(t, result.IsMember)
+	requireCause(t, causeChan, errShortCircuitUnsatisfied)
+}
+
+func TestDifferenceCancelsSiblingsWithCauseMatchingOutcome(t *testing.T) {
+	t.Run("base not member short-circuits with unsatisfied", func(t *testing.T) {
+		causeChan := make(chan error, 1)
+		result := Difference(context.Background(), []ReduceableCheckFunc{notMember(), observeCause(causeChan)})
+		require.False(t, result.IsMember)
+		requireCause(t, causeChan, errShortCircuitUnsatisfied)
+	})
+
+	t.Run("a failing sibling short-circuits with sibling failed", func(t *testing.T) {
+		causeChan := make(chan error, 1)
+		result := Difference(context.Background(), []ReduceableCheckFunc{member(), failingCheck(), observeCause(causeChan)})
+		require.Error(t, result.Err)
+		requireCause(t, causeChan, errSiblingFailed)
+	})
+}
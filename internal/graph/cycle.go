@@ -0,0 +1,103 @@
+package graph
+
+import (
+	"context"
+
+	v0 "github.com/authzed/spicedb/pkg/proto/authzed/api/v0"
+)
+
+// DefaultDepthRemaining is the recursion budget used when a caller doesn't specify one. It has
+// been raised substantially now that cyclePath cuts pathological (cyclic) userset graphs off
+// immediately, rather than depending on DepthRemaining to eventually exhaust; DepthRemaining
+// remains only as a backstop against graphs that are deep but not cyclic.
+const DefaultDepthRemaining = 250
+
+// onrKey is the comparable form of an ObjectAndRelation, suitable for use as a map key or for
+// equality checks while walking a cyclePath.
+type onrKey struct {
+	namespace string
+	objectID  string
+	relation  string
+}
+
+func onrKeyFromONR(onr *v0.ObjectAndRelation) onrKey {
+	return onrKey{namespace: onr.Namespace, objectID: onr.ObjectId, relation: onr.Relation}
+}
+
+// cyclePath is a persistent set of the ONRs dispatched-through on the way to the current subcheck.
+// Each node points at its parent instead of copying the accumulated set, so fanning out to many
+// siblings (e.g. from a tuple-to-userset join) is O(1) per sibling and each sibling gets its own
+// read-only view without the others' branches leaking into it.
+type cyclePath struct {
+	key    onrKey
+	parent *cyclePath
+	depth  int
+}
+
+// newCyclePath starts a fresh path rooted at the top-level Check's Start ONR.
+func newCyclePath(start *v0.ObjectAndRelation) *cyclePath {
+	return &cyclePath{key: onrKeyFromONR(start), depth: 1}
+}
+
+// contains reports whether onr is already on this path, i.e. dispatching to it would re-enter a
+// cycle rather than make progress toward the goal.
+func (p *cyclePath) contains(onr *v0.ObjectAndRelation) bool {
+	key := onrKeyFromONR(onr)
+	for node := p; node != nil; node = node.parent {
+		if node.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// extend returns a new path with onr appended, sharing the existing path's storage. The receiver
+// is left untouched, so it is safe to extend the same path independently for multiple siblings.
+func (p *cyclePath) extend(onr *v0.ObjectAndRelation) *cyclePath {
+	depth := 1
+	if p != nil {
+		depth = p.depth + 1
+	}
+	return &cyclePath{key: onrKeyFromONR(onr), parent: p, depth: depth}
+}
+
+// depthOf returns the number of ONRs on the path, or 0 for a nil path.
+func (p *cyclePath) depthOf() int {
+	if p == nil {
+		return 0
+	}
+	return p.depth
+}
+
+// mergeMetadata folds in's observability counters into acc: CycleAvoidedDispatches accumulates
+// across every child a reducer consulted, and EffectiveDepth reports the deepest any of them
+// recursed to. Reducers (All, Any, Difference) call this for every child result they observe, not
+// just the one that ultimately decides the outcome, so a cycle avoided three branches over in an
+// intersection still shows up in the result the caller of Check actually sees.
+func mergeMetadata(acc, in CheckResultMetadata) CheckResultMetadata {
+	merged := CheckResultMetadata{
+		EffectiveDepth:         acc.EffectiveDepth,
+		CycleAvoidedDispatches: acc.CycleAvoidedDispatches + in.CycleAvoidedDispatches,
+	}
+	if in.EffectiveDepth > merged.EffectiveDepth {
+		merged.EffectiveDepth = in.EffectiveDepth
+	}
+	return merged
+}
+
+// cycleAvoided is returned in place of dispatching to an ONR that's already on the current path.
+// It reports NotMember, since a well-formed check can never need to revisit an ONR it has already
+// walked through to make progress: if that ONR could reach the goal, it would have been found the
+// first time it was on the path.
+func cycleAvoided(path *cyclePath) ReduceableCheckFunc {
+	return func(ctx context.Context, resultChan chan<- CheckResult) {
+		resultChan <- CheckResult{
+			IsMember: false,
+			Err:      nil,
+			Metadata: CheckResultMetadata{
+				EffectiveDepth:         path.depthOf(),
+				CycleAvoidedDispatches: 1,
+			},
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package graph
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	v0 "github.com/authzed/spicedb/pkg/proto/authzed/api/v0"
+)
+
+func onr(objectID string) *v0.ObjectAndRelation {
+	return &v0.ObjectAndRelation{Namespace: "document", ObjectId: objectID, Relation: "viewer"}
+}
+
+func TestCyclePathContainsAndExtend(t *testing.T) {
+	root := newCyclePath(onr("1"))
+	require.True(t, root.contains(onr("1")))
+	require.False(t, root.contains(onr("2")))
+
+	extended := root.extend(onr("2"))
+	require.True(t, extended.contains(onr("1")), "extend must not lose the parent's ancestry")
+	require.True(t, extended.contains(onr("2")))
+	require.True(t, root.contains(onr("1")))
+	require.False(t, root.contains(onr("2")), "extending a path must not mutate the original, shared branch")
+
+	require.Equal(t, 1, root.depthOf())
+	require.Equal(t, 2, extended.depthOf())
+}
+
+func TestCycleAvoidedReportsDepthAndCount(t *testing.T) {
+	path := newCyclePath(onr("1")).extend(onr("2"))
+
+	resultChan := make(chan CheckResult, 1)
+	cycleAvoided(path)(context.Background(), resultChan)
+	result := <-resultChan
+
+	require.False(t, result.IsMember)
+	require.NoError(t, result.Err)
+	require.Equal(t, 1, result.Metadata.CycleAvoidedDispatches)
+	require.Equal(t, path.depthOf(), result.Metadata.EffectiveDepth)
+}
+
+func TestMergeMetadataSumsCountsAndTakesMaxDepth(t *testing.T) {
+	acc := CheckResultMetadata{EffectiveDepth: 3, CycleAvoidedDispatches: 1}
+	in := CheckResultMetadata{EffectiveDepth: 5, CycleAvoidedDispatches: 2}
+
+	merged := mergeMetadata(acc, in)
+
+	require.Equal(t, 5, merged.EffectiveDepth)
+	require.Equal(t, 3, merged.CycleAvoidedDispatches)
+}
+
+// DefaultDepthRemaining's doc comment claims DepthRemaining is a real backstop against deep,
+// non-cyclic graphs; dispatch has to actually enforce it for that to be true.
+func TestDispatchEnforcesDepthRemainingBackstop(t *testing.T) {
+	cc := &concurrentChecker{d: &fakeDispatcher{checkFn: func(ctx context.Context, req CheckRequest) CheckResult {
+		t.Fatal("delegate must not be called once the recursion depth budget is exhausted")
+		return CheckResult{}
+	}}}
+
+	start := onr("1")
+	req := CheckRequest{
+		Start:          start,
+		Goal:           &v0.ObjectAndRelation{Namespace: "user", ObjectId: "tom", Relation: Ellipsis},
+		VisitedPath:    newCyclePath(start),
+		DepthRemaining: 0,
+	}
+
+	resultChan := make(chan CheckResult, 1)
+	cc.dispatch(req)(context.Background(), resultChan)
+	result := <-resultChan
+
+	require.False(t, result.IsMember)
+	require.ErrorIs(t, result.Err, errMaxDepthExceeded)
+}
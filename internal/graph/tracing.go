@@ -0,0 +1,110 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer emits one span per dispatched subcheck, so that a single top-level Check produces a full
+// tree of spans in Jaeger/Tempo, even across the concurrent fan-out done by Any/All/Difference.
+var tracer = otel.Tracer("github.com/authzed/spicedb/internal/graph")
+
+// Span kinds, one per ReduceableCheckFunc-producing method on concurrentChecker.
+const (
+	spanKindDirect          = "direct"
+	spanKindComputedUserset = "computed_userset"
+	spanKindTupleToUserset  = "tuple_to_userset"
+	spanKindUnion           = "union"
+	spanKindIntersection    = "intersection"
+	spanKindExclusion       = "exclusion"
+	spanKindDispatch        = "dispatch"
+)
+
+// Span events recorded when a set-operation reducer short-circuits its siblings.
+const (
+	eventShortCircuitMember    = "short_circuit.member"
+	eventShortCircuitNotMember = "short_circuit.not_member"
+)
+
+// startCheckSpan opens a span for a dispatched subcheck of the given kind, tagging it with the
+// request's Start/Goal ONRs, remaining recursion depth, and revision so the resulting trace can be
+// read back as the shape of the permission check. If ctx carries a child index (see
+// contextWithChildIndex), it's attached too, so a set operation's children can be told apart in
+// the trace even though the reducers dispatch them concurrently.
+func startCheckSpan(ctx context.Context, kind string, req CheckRequest, extraAttrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs := append([]attribute.KeyValue{
+		attribute.String("start.namespace", req.Start.Namespace),
+		attribute.String("start.object_id", req.Start.ObjectId),
+		attribute.String("start.relation", req.Start.Relation),
+		attribute.String("goal.namespace", req.Goal.Namespace),
+		attribute.String("goal.object_id", req.Goal.ObjectId),
+		attribute.String("goal.relation", req.Goal.Relation),
+		attribute.Int("depth_remaining", int(req.DepthRemaining)),
+		attribute.String("at_revision", fmt.Sprintf("%v", req.AtRevision)),
+	}, extraAttrs...)
+	if index, ok := childIndexFromContext(ctx); ok {
+		attrs = append(attrs, attribute.Int("child_index", index))
+	}
+
+	return tracer.Start(ctx, kind, trace.WithAttributes(attrs...))
+}
+
+// childIndexContextKey is the context key under which a set operation's dispatched children carry
+// their position among their siblings (see contextWithChildIndex).
+type childIndexContextKey struct{}
+
+// contextWithChildIndex returns a copy of ctx tagged with index, the position of a dispatched
+// child within the set operation that's fanning it out. checkSetOperation tags each child's
+// context this way before dispatch, so that the span startCheckSpan opens for it reports where in
+// the original union/intersection/exclusion order it belongs, letting a trace reconstruct that
+// order after the fact even though the reducers run the children concurrently.
+func contextWithChildIndex(ctx context.Context, index int) context.Context {
+	return context.WithValue(ctx, childIndexContextKey{}, index)
+}
+
+// childIndexFromContext returns the child index attached by contextWithChildIndex, if any.
+func childIndexFromContext(ctx context.Context) (int, bool) {
+	index, ok := ctx.Value(childIndexContextKey{}).(int)
+	return index, ok
+}
+
+// traceCarrier is the wire-format TraceContext embedded in a dispatched CheckRequest, so that a
+// subcheck forwarded to another node over Dispatcher.Check continues the same trace rather than
+// starting a new one.
+type traceCarrier map[string]string
+
+// injectTraceContext captures ctx's current span context into a carrier suitable for attaching to
+// a CheckRequest that is about to be dispatched, possibly across a process boundary.
+func injectTraceContext(ctx context.Context) traceCarrier {
+	carrier := make(traceCarrier)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(carrier))
+	return carrier
+}
+
+// extractTraceContext rehydrates a span context from a dispatched CheckRequest's TraceContext, if
+// present, so that spans opened while servicing it are parented to the originating caller's trace
+// rather than starting a new, disconnected one.
+func extractTraceContext(ctx context.Context, req CheckRequest) context.Context {
+	if len(req.TraceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(req.TraceContext))
+}
+
+// NewTraceSampler builds the sampler used by the graph package's TracerProvider. ratio is the
+// fraction of top-level Check calls (and therefore their whole subcheck tree) that get traced;
+// production deployments should keep this well below 1 to avoid overwhelming the trace backend
+// with the per-subcheck span volume that deep userset graphs produce.
+func NewTraceSampler(ratio float64) sdktrace.Sampler {
+	return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))
+}
+
+func recordShortCircuit(ctx context.Context, event string) {
+	trace.SpanFromContext(ctx).AddEvent(event)
+}
@@ -0,0 +1,34 @@
+package graph
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChildIndexRoundTripsThroughContext(t *testing.T) {
+	_, ok := childIndexFromContext(context.Background())
+	require.False(t, ok, "a context with no child index attached must report ok=false")
+
+	tagged := contextWithChildIndex(context.Background(), 2)
+	index, ok := childIndexFromContext(tagged)
+	require.True(t, ok)
+	require.Equal(t, 2, index)
+}
+
+func TestWithChildIndexTagsTheContextPassedToFn(t *testing.T) {
+	var observed int
+	var ok bool
+	fn := withChildIndex(3, func(ctx context.Context, resultChan chan<- CheckResult) {
+		observed, ok = childIndexFromContext(ctx)
+		resultChan <- CheckResult{}
+	})
+
+	resultChan := make(chan CheckResult, 1)
+	fn(context.Background(), resultChan)
+	<-resultChan
+
+	require.True(t, ok)
+	require.Equal(t, 3, observed)
+}